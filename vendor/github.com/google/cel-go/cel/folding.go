@@ -0,0 +1,563 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cel
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/proto"
+)
+
+// ConstantFoldingOption configures the behavior of a ConstantFoldingOptimizer.
+type ConstantFoldingOption func(*constantFoldingOptimizer) *constantFoldingOptimizer
+
+// ExtraFoldableFunctions registers additional pure function names which are eligible for
+// constant folding whenever all of their arguments are constant, beyond the standard arithmetic,
+// comparison, logical, and list / map indexing builtins the optimizer already folds.
+//
+// Evaluation goes through evalBuiltin, which implements only a fixed set of operators. A call to
+// a registered name outside that set passes the foldability check, but its evaluation fails, so
+// the call is left unfolded.
+func ExtraFoldableFunctions(names ...string) ConstantFoldingOption {
+	return func(opt *constantFoldingOptimizer) *constantFoldingOptimizer {
+		for _, name := range names {
+			opt.foldableFunctions[name] = true
+		}
+		return opt
+	}
+}
+
+// NewConstantFoldingOptimizer returns an Optimizer which rewrites constant sub-expressions of a
+// checked AST into their evaluated literal, list, or map form.
+//
+// The optimizer runs to a fixed point, since folding a subtree can expose new foldable parents
+// (folding `1 + 2` into `3` may make a surrounding `3 == x` foldable once `x` is also constant).
+// It also prunes the dead branch of a `_?_:_` conditional and short-circuits `&&` / `||`
+// whenever the guard is a constant, and unrolls `.exists`, `.all`, `.map`, and `.filter`
+// comprehensions whose iter-range is a constant list or map.
+//
+// Any evaluation error encountered while folding a constant sub-expression (for example, a
+// division by zero) is not treated as a compile-time failure; the offending sub-expression is
+// simply left unfolded so it still raises the same error at evaluation time, and the folded AST
+// retains the same evaluation semantics as the input.
+func NewConstantFoldingOptimizer(opts ...ConstantFoldingOption) Optimizer {
+	opt := &constantFoldingOptimizer{foldableFunctions: defaultFoldableFunctions()}
+	for _, o := range opts {
+		opt = o(opt)
+	}
+	return opt
+}
+
+func defaultFoldableFunctions() map[string]bool {
+	names := []string{
+		operators.Add, operators.Subtract, operators.Multiply, operators.Divide, operators.Modulo,
+		operators.Negate,
+		operators.Equals, operators.NotEquals,
+		operators.Less, operators.LessEquals, operators.Greater, operators.GreaterEquals,
+		operators.LogicalAnd, operators.LogicalOr, operators.LogicalNot,
+		operators.Index,
+	}
+	fns := make(map[string]bool, len(names))
+	for _, n := range names {
+		fns[n] = true
+	}
+	return fns
+}
+
+type constantFoldingOptimizer struct {
+	foldableFunctions map[string]bool
+}
+
+// Optimize implements the Optimizer interface.
+func (opt *constantFoldingOptimizer) Optimize(a *Ast) (*Ast, error) {
+	nextID := newOptimizerIDGen(a)
+	checked := copyCheckedAST(a.impl)
+	for {
+		changed := false
+		for _, node := range ast.MatchDescendants(ast.NavigateCheckedAST(checked), ast.AllMatcher()) {
+			replacement, ok := opt.foldNode(node, nextID, checked.TypeMap)
+			if !ok {
+				continue
+			}
+			opt.replace(checked, node, replacement)
+			changed = true
+			// Folding mutates the tree `node` was navigated from, so restart the scan from a
+			// fresh traversal rather than continuing to iterate over now-stale NavigableExprs.
+			break
+		}
+		if !changed {
+			return &Ast{impl: checked}, nil
+		}
+	}
+}
+
+// copyCheckedAST returns a deep copy of checked, so that folding the copy never mutates the
+// *Ast the caller handed to Optimize -- the Optimizer interface requires the input be left safe
+// to reuse.
+func copyCheckedAST(checked *ast.CheckedAST) *ast.CheckedAST {
+	typeMap := make(map[int64]*types.Type, len(checked.TypeMap))
+	for id, t := range checked.TypeMap {
+		typeMap[id] = t
+	}
+	return &ast.CheckedAST{Expr: proto.Clone(checked.Expr).(*exprpb.Expr), TypeMap: typeMap}
+}
+
+// foldNode attempts to fold a single node, returning its replacement and true if it was folded.
+//
+// Only Call and Comprehension nodes are ever evaluated here. A bare literal, list, map, or
+// struct node is already in its most-folded form: re-evaluating it would just re-emit a
+// structurally identical replacement with fresh IDs, which would never reach a fixed point.
+func (opt *constantFoldingOptimizer) foldNode(node ast.NavigableExpr, nextID func() int64, typeMap map[int64]*types.Type) (*exprpb.Expr, bool) {
+	switch node.Kind() {
+	case ast.CallKind:
+		return opt.foldCall(node, nextID, typeMap)
+	case ast.ComprehensionKind:
+		return opt.foldComprehension(node, nextID, typeMap)
+	default:
+		return nil, false
+	}
+}
+
+func (opt *constantFoldingOptimizer) foldCall(node ast.NavigableExpr, nextID func() int64, typeMap map[int64]*types.Type) (*exprpb.Expr, bool) {
+	call := node.AsCall()
+	fn := call.FunctionName()
+	args := call.Args()
+	// Dead-branch pruning and short-circuiting only require the guard(s) to be constant.
+	switch fn {
+	case operators.Conditional:
+		if len(args) == 3 && ast.ConstantValueMatcher()(args[0]) {
+			if asBool(args[0].AsLiteral()) {
+				return args[1].ToExpr(), true
+			}
+			return args[2].ToExpr(), true
+		}
+		return nil, false
+	case operators.LogicalAnd:
+		for _, arg := range args {
+			if ast.ConstantValueMatcher()(arg) && !asBool(arg.AsLiteral()) {
+				return arg.ToExpr(), true
+			}
+		}
+	case operators.LogicalOr:
+		for _, arg := range args {
+			if ast.ConstantValueMatcher()(arg) && asBool(arg.AsLiteral()) {
+				return arg.ToExpr(), true
+			}
+		}
+	}
+	if !opt.foldableFunctions[fn] {
+		return nil, false
+	}
+	// A call is foldable once every operand is a foldable constant; NavigableExpr.Kind() never
+	// reports CallKind itself as "constant" (only the leaf/collection kinds do), so the operands
+	// must be checked individually rather than checking the call node as a whole.
+	if call.Target() != nil && !isFoldableConstant(call.Target()) {
+		return nil, false
+	}
+	for _, arg := range args {
+		if !isFoldableConstant(arg) {
+			return nil, false
+		}
+	}
+	return opt.evalToExpr(node.ToExpr(), nextID, typeMap)
+}
+
+// foldComprehension unrolls a comprehension whose iter-range is a constant list or map by
+// evaluating the iter-range, accu-init, loop-condition, loop-step, and result expressions
+// directly, the same way the interpreter would at runtime, and folding the outcome to a literal.
+func (opt *constantFoldingOptimizer) foldComprehension(node ast.NavigableExpr, nextID func() int64, typeMap map[int64]*types.Type) (*exprpb.Expr, bool) {
+	comp := node.AsComprehension()
+	if !isFoldableConstant(comp.IterRange()) {
+		return nil, false
+	}
+	if k := comp.IterRange().Kind(); k != ast.ListKind && k != ast.MapKind {
+		return nil, false
+	}
+	return opt.evalToExpr(node.ToExpr(), nextID, typeMap)
+}
+
+// isFoldableConstant reports whether node is a constant value this optimizer is willing to
+// evaluate. Unlike ast.ConstantValueMatcher, proto message literals (StructKind) are excluded at
+// any depth: constructing a message may have side effects or validation that folding must not
+// silently skip, so a message literal and anything containing one is left exactly as written.
+func isFoldableConstant(node ast.NavigableExpr) bool {
+	if !ast.ConstantValueMatcher()(node) {
+		return false
+	}
+	if node.Kind() == ast.StructKind {
+		return false
+	}
+	for _, child := range node.Children() {
+		if !isFoldableConstant(child) {
+			return false
+		}
+	}
+	return true
+}
+
+// evalToExpr evaluates expr and returns its folded literal replacement. If evaluation fails (for
+// example, a division by zero), expr is left unfolded -- ok is false -- so it still raises the
+// same error at evaluation time instead of being replaced by a node describing the error, which
+// would silently change the expression's runtime semantics.
+func (opt *constantFoldingOptimizer) evalToExpr(expr *exprpb.Expr, nextID func() int64, typeMap map[int64]*types.Type) (*exprpb.Expr, bool) {
+	val, err := opt.eval(expr, map[string]ref.Val{})
+	if err != nil {
+		return nil, false
+	}
+	return valToExpr(val, nextID, typeMap), true
+}
+
+// replace splices replacement in place of node and keeps checked.TypeMap consistent: every id
+// that appeared in node's old subtree (including map/struct entry ids, which share the same id
+// space) is dropped unless replacement's subtree reuses it, and replacement's own id is recorded
+// with node's original, checker-inferred type if folding didn't already assign it one (e.g. when
+// dead-branch pruning reuses an existing, already-typed subtree as the replacement).
+func (opt *constantFoldingOptimizer) replace(checked *ast.CheckedAST, node ast.NavigableExpr, replacement *exprpb.Expr) {
+	oldIDs := subtreeIDs(node.ToExpr())
+	newIDs := subtreeIDs(replacement)
+	nodeType := node.Type()
+	*node.ToExpr() = *replacement
+	for id := range oldIDs {
+		if !newIDs[id] {
+			delete(checked.TypeMap, id)
+		}
+	}
+	if _, ok := checked.TypeMap[replacement.GetId()]; !ok {
+		checked.TypeMap[replacement.GetId()] = nodeType
+	}
+}
+
+// subtreeIDs returns the set of every expression ID in expr's subtree, including the
+// Expr_CreateStruct_Entry ids of map entries and struct field initializers, which factory.go
+// allocates in the same id space as Expr.Id.
+func subtreeIDs(expr *exprpb.Expr) map[int64]bool {
+	ids := make(map[int64]bool)
+	var walk func(e *exprpb.Expr)
+	walk = func(e *exprpb.Expr) {
+		if e == nil {
+			return
+		}
+		ids[e.GetId()] = true
+		switch k := e.GetExprKind().(type) {
+		case *exprpb.Expr_SelectExpr:
+			walk(k.SelectExpr.GetOperand())
+		case *exprpb.Expr_CallExpr:
+			walk(k.CallExpr.GetTarget())
+			for _, arg := range k.CallExpr.GetArgs() {
+				walk(arg)
+			}
+		case *exprpb.Expr_ListExpr:
+			for _, el := range k.ListExpr.GetElements() {
+				walk(el)
+			}
+		case *exprpb.Expr_StructExpr:
+			for _, entry := range k.StructExpr.GetEntries() {
+				ids[entry.GetId()] = true
+				walk(entry.GetMapKey())
+				walk(entry.GetValue())
+			}
+		case *exprpb.Expr_ComprehensionExpr:
+			c := k.ComprehensionExpr
+			walk(c.GetIterRange())
+			walk(c.GetAccuInit())
+			walk(c.GetLoopCondition())
+			walk(c.GetLoopStep())
+			walk(c.GetResult())
+		}
+	}
+	walk(expr)
+	return ids
+}
+
+// eval evaluates expr under env, the substitution of identifiers to already-bound values, using
+// the same operator semantics the runtime interpreter applies. It is only ever invoked on
+// expressions already confirmed to be constant (modulo the identifiers bound in env), so it
+// never needs to consult an external Activation.
+func (opt *constantFoldingOptimizer) eval(expr *exprpb.Expr, env map[string]ref.Val) (ref.Val, error) {
+	switch e := expr.GetExprKind().(type) {
+	case *exprpb.Expr_ConstExpr:
+		return ast.ConstantToVal(e.ConstExpr)
+	case *exprpb.Expr_IdentExpr:
+		if v, found := env[e.IdentExpr.GetName()]; found {
+			return v, nil
+		}
+		return nil, fmt.Errorf("no value bound for identifier %q", e.IdentExpr.GetName())
+	case *exprpb.Expr_ListExpr:
+		elems := make([]ref.Val, len(e.ListExpr.GetElements()))
+		for i, el := range e.ListExpr.GetElements() {
+			v, err := opt.eval(el, env)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = v
+		}
+		return types.DefaultTypeAdapter.NativeToValue(elems), nil
+	case *exprpb.Expr_StructExpr:
+		if e.StructExpr.GetMessageName() != "" {
+			return nil, fmt.Errorf("struct literal %q is not foldable", e.StructExpr.GetMessageName())
+		}
+		m := make(map[ref.Val]ref.Val, len(e.StructExpr.GetEntries()))
+		for _, entry := range e.StructExpr.GetEntries() {
+			k, err := opt.eval(entry.GetMapKey(), env)
+			if err != nil {
+				return nil, err
+			}
+			v, err := opt.eval(entry.GetValue(), env)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return types.NewRefValMap(types.DefaultTypeAdapter, m), nil
+	case *exprpb.Expr_CallExpr:
+		return opt.evalCall(e.CallExpr, env)
+	case *exprpb.Expr_ComprehensionExpr:
+		return opt.evalComprehension(e.ComprehensionExpr, env)
+	default:
+		return nil, fmt.Errorf("expression kind %T is not foldable", e)
+	}
+}
+
+func (opt *constantFoldingOptimizer) evalCall(call *exprpb.Expr_Call, env map[string]ref.Val) (ref.Val, error) {
+	argExprs := call.GetArgs()
+	if call.GetTarget() != nil {
+		argExprs = append([]*exprpb.Expr{call.GetTarget()}, argExprs...)
+	}
+	args := make([]ref.Val, len(argExprs))
+	for i, a := range argExprs {
+		v, err := opt.eval(a, env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return evalBuiltin(call.GetFunction(), args)
+}
+
+func (opt *constantFoldingOptimizer) evalComprehension(comp *exprpb.Expr_Comprehension, env map[string]ref.Val) (ref.Val, error) {
+	iterRange, err := opt.eval(comp.GetIterRange(), env)
+	if err != nil {
+		return nil, err
+	}
+	accu, err := opt.eval(comp.GetAccuInit(), env)
+	if err != nil {
+		return nil, err
+	}
+	iterate := func(iterVal ref.Val) error {
+		loopEnv := make(map[string]ref.Val, len(env)+2)
+		for k, v := range env {
+			loopEnv[k] = v
+		}
+		loopEnv[comp.GetIterVar()] = iterVal
+		loopEnv[comp.GetAccuVar()] = accu
+		cond, err := opt.eval(comp.GetLoopCondition(), loopEnv)
+		if err != nil {
+			return err
+		}
+		if !asBool(cond) {
+			return errStopIteration
+		}
+		accu, err = opt.eval(comp.GetLoopStep(), loopEnv)
+		return err
+	}
+	var iterErr error
+	switch it := iterRange.(type) {
+	case traits.Lister:
+		sz := int64(it.Size().(types.Int))
+		for i := int64(0); i < sz; i++ {
+			if iterErr = iterate(it.Get(types.Int(i))); iterErr != nil {
+				break
+			}
+		}
+	case traits.Mapper:
+		iter := it.Iterator()
+		for iter.HasNext() == types.True {
+			if iterErr = iterate(iter.Next()); iterErr != nil {
+				break
+			}
+		}
+	default:
+		return nil, fmt.Errorf("comprehension range of type %T is not foldable", iterRange)
+	}
+	if iterErr != nil && iterErr != errStopIteration {
+		return nil, iterErr
+	}
+	resultEnv := make(map[string]ref.Val, len(env)+1)
+	for k, v := range env {
+		resultEnv[k] = v
+	}
+	resultEnv[comp.GetAccuVar()] = accu
+	return opt.eval(comp.GetResult(), resultEnv)
+}
+
+var errStopIteration = fmt.Errorf("loop condition false")
+
+func asBool(v ref.Val) bool {
+	b, ok := v.(types.Bool)
+	return ok && bool(b)
+}
+
+// evalBuiltin evaluates one of the default foldable builtins against already-evaluated args,
+// dispatching through the same ref.Val trait interfaces (traits.Adder, traits.Comparer, ...) the
+// interpreter uses at runtime, so a folded result never diverges from unfolded evaluation.
+func evalBuiltin(fn string, args []ref.Val) (ref.Val, error) {
+	switch fn {
+	case operators.Conditional:
+		if asBool(args[0]) {
+			return args[1], nil
+		}
+		return args[2], nil
+	case operators.NotStrictlyFalse:
+		// not_strictly_false(x) is the comprehension loop-condition guard macros like .all and
+		// .exists compile to: it evaluates to true unless x is the concrete value false, so that
+		// an error or unknown loop condition doesn't silently stop iteration.
+		if b, ok := args[0].(types.Bool); ok {
+			return b, nil
+		}
+		return types.True, nil
+	case operators.Add:
+		return traitResult(args[0].(traits.Adder).Add(args[1]))
+	case operators.Subtract:
+		return traitResult(args[0].(traits.Subtractor).Subtract(args[1]))
+	case operators.Multiply:
+		return traitResult(args[0].(traits.Multiplier).Multiply(args[1]))
+	case operators.Divide:
+		return traitResult(args[0].(traits.Divider).Divide(args[1]))
+	case operators.Modulo:
+		return traitResult(args[0].(traits.Modder).Modulo(args[1]))
+	case operators.Negate:
+		return traitResult(args[0].(traits.Negater).Negate())
+	case operators.LogicalNot:
+		return types.Bool(!bool(args[0].(types.Bool))), nil
+	case operators.LogicalAnd:
+		for _, a := range args {
+			if !asBool(a) {
+				return types.False, nil
+			}
+		}
+		return types.True, nil
+	case operators.LogicalOr:
+		for _, a := range args {
+			if asBool(a) {
+				return types.True, nil
+			}
+		}
+		return types.False, nil
+	case operators.Equals:
+		return traitResult(args[0].Equal(args[1]))
+	case operators.NotEquals:
+		eq, err := traitResult(args[0].Equal(args[1]))
+		if err != nil {
+			return nil, err
+		}
+		return types.Bool(!bool(eq.(types.Bool))), nil
+	case operators.Less, operators.LessEquals, operators.Greater, operators.GreaterEquals:
+		cmp, err := traitResult(args[0].(traits.Comparer).Compare(args[1]))
+		if err != nil {
+			return nil, err
+		}
+		c := int(cmp.(types.Int))
+		switch fn {
+		case operators.Less:
+			return types.Bool(c < 0), nil
+		case operators.LessEquals:
+			return types.Bool(c <= 0), nil
+		case operators.Greater:
+			return types.Bool(c > 0), nil
+		default:
+			return types.Bool(c >= 0), nil
+		}
+	case operators.Index:
+		return traitResult(args[0].(traits.Indexer).Get(args[1]))
+	default:
+		return nil, fmt.Errorf("function %q is not a foldable builtin", fn)
+	}
+}
+
+func traitResult(v ref.Val) (ref.Val, error) {
+	if err, ok := v.(*types.Err); ok {
+		return nil, err
+	}
+	return v, nil
+}
+
+// valToExpr rewrites val into a literal, list, or map expression tree, allocating a fresh ID
+// from nextID for every node it creates -- including nested elements, map entries, and the
+// Expr_CreateStruct_Entry wrappers a map literal needs -- and recording the type of each
+// expression node in typeMap. The entry wrapper IDs get no type-map entry.
+func valToExpr(val ref.Val, nextID func() int64, typeMap map[int64]*types.Type) *exprpb.Expr {
+	id := nextID()
+	setType := func(t *types.Type) {
+		if typeMap != nil {
+			typeMap[id] = t
+		}
+	}
+	switch v := val.(type) {
+	case types.Bool:
+		setType(types.BoolType)
+		return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_BoolValue{BoolValue: bool(v)}}}}
+	case types.Int:
+		setType(types.IntType)
+		return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_Int64Value{Int64Value: int64(v)}}}}
+	case types.Uint:
+		setType(types.UintType)
+		return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_Uint64Value{Uint64Value: uint64(v)}}}}
+	case types.Double:
+		setType(types.DoubleType)
+		return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_DoubleValue{DoubleValue: float64(v)}}}}
+	case types.String:
+		setType(types.StringType)
+		return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_StringValue{StringValue: string(v)}}}}
+	case types.Bytes:
+		setType(types.BytesType)
+		return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_BytesValue{BytesValue: []byte(v)}}}}
+	case traits.Lister:
+		setType(types.NewListType(types.DynType))
+		sz := int64(v.Size().(types.Int))
+		elems := make([]*exprpb.Expr, sz)
+		for i := int64(0); i < sz; i++ {
+			elems[i] = valToExpr(v.Get(types.Int(i)), nextID, typeMap)
+		}
+		return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ListExpr{ListExpr: &exprpb.Expr_CreateList{Elements: elems}}}
+	case traits.Mapper:
+		setType(types.NewMapType(types.DynType, types.DynType))
+		var entries []*exprpb.Expr_CreateStruct_Entry
+		iter := v.Iterator()
+		for iter.HasNext() == types.True {
+			k := iter.Next()
+			entryID := nextID()
+			keyExpr := valToExpr(k, nextID, typeMap)
+			valExpr := valToExpr(v.Get(k), nextID, typeMap)
+			entries = append(entries, &exprpb.Expr_CreateStruct_Entry{
+				Id:      entryID,
+				KeyKind: &exprpb.Expr_CreateStruct_Entry_MapKey{MapKey: keyExpr},
+				Value:   valExpr,
+			})
+		}
+		return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_StructExpr{StructExpr: &exprpb.Expr_CreateStruct{Entries: entries}}}
+	default:
+		// eval only ever succeeds with the value kinds handled above; reaching here means eval
+		// returned a value of a kind this optimizer doesn't know how to re-literalize, which is a
+		// bug in the optimizer rather than a foldable-or-not judgment about the input expression.
+		panic(fmt.Sprintf("value of type %T is not foldable to a literal", val))
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+func intLit(id int64, v int64) *exprpb.Expr {
+	return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_Int64Value{Int64Value: v}}}}
+}
+
+func listLit(id int64, elems ...*exprpb.Expr) *exprpb.Expr {
+	return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ListExpr{ListExpr: &exprpb.Expr_CreateList{Elements: elems}}}
+}
+
+func call(id int64, fn string, args ...*exprpb.Expr) *exprpb.Expr {
+	return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_CallExpr{CallExpr: &exprpb.Expr_Call{Function: fn, Args: args}}}
+}
+
+func boolLit(id int64, v bool) *exprpb.Expr {
+	return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_BoolValue{BoolValue: v}}}}
+}
+
+func identExpr(id int64, name string) *exprpb.Expr {
+	return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_IdentExpr{IdentExpr: &exprpb.Expr_Ident{Name: name}}}
+}
+
+func newTestAst(root *exprpb.Expr, typeMap map[int64]*types.Type) *Ast {
+	if typeMap == nil {
+		typeMap = map[int64]*types.Type{}
+	}
+	return CheckedASTToAst(&ast.CheckedAST{Expr: root, TypeMap: typeMap})
+}
+
+func TestConstantFoldingOptimizerArithmetic(t *testing.T) {
+	// 1 + 2
+	in := newTestAst(call(1, operators.Add, intLit(2, 1), intLit(3, 2)), map[int64]*types.Type{1: types.IntType})
+	out, err := NewConstantFoldingOptimizer().Optimize(in)
+	if err != nil {
+		t.Fatalf("Optimize() failed: %v", err)
+	}
+	root := ast.NavigateCheckedAST(AstToCheckedAST(out))
+	if root.Kind() != ast.LiteralKind || root.AsLiteral().Equal(types.Int(3)) != types.True {
+		t.Errorf("got %v, wanted folded literal 3", root.ToExpr())
+	}
+}
+
+func TestConstantFoldingOptimizerListLiteralIsStable(t *testing.T) {
+	// A bare constant list isn't consumed by any foldable parent. Folding it must converge
+	// immediately rather than looping forever re-emitting an equivalent list.
+	in := newTestAst(listLit(1, intLit(2, 1), intLit(3, 2)), nil)
+	done := make(chan struct{})
+	var out *Ast
+	var err error
+	go func() {
+		out, err = NewConstantFoldingOptimizer().Optimize(in)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Optimize() did not converge on a bare constant list literal")
+	}
+	if err != nil {
+		t.Fatalf("Optimize() failed: %v", err)
+	}
+	root := ast.NavigateCheckedAST(AstToCheckedAST(out))
+	if root.Kind() != ast.ListKind || len(root.AsList().Elements()) != 2 {
+		t.Errorf("got %v, wanted the input list left untouched", root.ToExpr())
+	}
+}
+
+func TestConstantFoldingOptimizerLeavesDivisionByZeroUnfolded(t *testing.T) {
+	// 1 / 0 must not be folded into a value -- doing so would silently change the expression's
+	// runtime error semantics (for example, replacing the call with a string literal of the
+	// error text).
+	in := newTestAst(call(1, operators.Divide, intLit(2, 1), intLit(3, 0)), map[int64]*types.Type{1: types.IntType})
+	out, err := NewConstantFoldingOptimizer().Optimize(in)
+	if err != nil {
+		t.Fatalf("Optimize() failed: %v", err)
+	}
+	root := ast.NavigateCheckedAST(AstToCheckedAST(out))
+	if root.Kind() != ast.CallKind || root.AsCall().FunctionName() != operators.Divide {
+		t.Errorf("got %v, wanted 1 / 0 left unfolded so it still errors at eval time", root.ToExpr())
+	}
+}
+
+func TestConstantFoldingOptimizerComprehension(t *testing.T) {
+	// [1, 2, 3].exists(x, x == 2), in its desugared comprehension form.
+	iterRange := listLit(1, intLit(2, 1), intLit(3, 2), intLit(4, 3))
+	accuInit := boolLit(5, false)
+	loopCondition := call(8, operators.NotStrictlyFalse, call(7, operators.LogicalNot, identExpr(6, "__result__")))
+	loopStep := call(11, operators.LogicalOr, identExpr(9, "__result__"), call(10, operators.Equals, identExpr(12, "x"), intLit(13, 2)))
+	comp := &exprpb.Expr{Id: 20, ExprKind: &exprpb.Expr_ComprehensionExpr{ComprehensionExpr: &exprpb.Expr_Comprehension{
+		IterRange:     iterRange,
+		IterVar:       "x",
+		AccuVar:       "__result__",
+		AccuInit:      accuInit,
+		LoopCondition: loopCondition,
+		LoopStep:      loopStep,
+		Result:        identExpr(14, "__result__"),
+	}}}
+	in := newTestAst(comp, nil)
+	out, err := NewConstantFoldingOptimizer().Optimize(in)
+	if err != nil {
+		t.Fatalf("Optimize() failed: %v", err)
+	}
+	root := ast.NavigateCheckedAST(AstToCheckedAST(out))
+	if root.Kind() != ast.LiteralKind || root.AsLiteral().Equal(types.True) != types.True {
+		t.Errorf("got %v, wanted [1, 2, 3].exists(x, x == 2) folded to the literal true", root.ToExpr())
+	}
+}
+
+func TestConstantFoldingOptimizerDoesNotMutateInput(t *testing.T) {
+	in := newTestAst(call(1, operators.Add, intLit(2, 1), intLit(3, 2)), map[int64]*types.Type{1: types.IntType})
+	inChecked := AstToCheckedAST(in)
+	if _, err := NewConstantFoldingOptimizer().Optimize(in); err != nil {
+		t.Fatalf("Optimize() failed: %v", err)
+	}
+	root := ast.NavigateCheckedAST(inChecked)
+	if root.Kind() != ast.CallKind || root.AsCall().FunctionName() != operators.Add {
+		t.Errorf("Optimize() mutated its input; got %v, wanted the original 1 + 2 call untouched", root.ToExpr())
+	}
+	if len(inChecked.TypeMap) != 1 {
+		t.Errorf("Optimize() mutated the input's TypeMap; got %d entries, wanted 1", len(inChecked.TypeMap))
+	}
+}
+
+func TestConstantFoldingOptimizerDropsOrphanedTypeMapEntries(t *testing.T) {
+	in := newTestAst(call(1, operators.Add, intLit(2, 1), intLit(3, 2)), map[int64]*types.Type{1: types.IntType, 2: types.IntType, 3: types.IntType})
+	out, err := NewConstantFoldingOptimizer().Optimize(in)
+	if err != nil {
+		t.Fatalf("Optimize() failed: %v", err)
+	}
+	checked := AstToCheckedAST(out)
+	for _, orphan := range []int64{1, 2, 3} {
+		if _, found := checked.TypeMap[orphan]; found {
+			t.Errorf("TypeMap still has an entry for folded-away id %d", orphan)
+		}
+	}
+	if len(checked.TypeMap) != 1 {
+		t.Errorf("TypeMap has %d entries, wanted exactly 1 for the folded literal", len(checked.TypeMap))
+	}
+}
+
+func TestConstantFoldingOptimizerSkipsMessageLiterals(t *testing.T) {
+	msg := &exprpb.Expr{Id: 1, ExprKind: &exprpb.Expr_StructExpr{StructExpr: &exprpb.Expr_CreateStruct{
+		MessageName: "google.protobuf.Timestamp",
+		Entries: []*exprpb.Expr_CreateStruct_Entry{{
+			Id:      2,
+			KeyKind: &exprpb.Expr_CreateStruct_Entry_FieldKey{FieldKey: "seconds"},
+			Value:   intLit(3, 100),
+		}},
+	}}}
+	in := newTestAst(msg, nil)
+	out, err := NewConstantFoldingOptimizer().Optimize(in)
+	if err != nil {
+		t.Fatalf("Optimize() failed: %v", err)
+	}
+	root := ast.NavigateCheckedAST(AstToCheckedAST(out))
+	if root.Kind() != ast.StructKind || root.AsStruct().TypeName() != "google.protobuf.Timestamp" {
+		t.Errorf("got %v, wanted the message literal left untouched, not folded to an error string", root.ToExpr())
+	}
+}
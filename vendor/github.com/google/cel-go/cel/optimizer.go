@@ -0,0 +1,62 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cel provides APIs for building and optimizing CEL expressions.
+package cel
+
+import (
+	"github.com/google/cel-go/common/ast"
+)
+
+// Ast wraps the checked representation of a CEL expression for use with the Optimizer pipeline.
+type Ast struct {
+	impl *ast.CheckedAST
+}
+
+// NativeRep exposes the underlying *ast.CheckedAST representation of this Ast.
+func (a *Ast) NativeRep() *ast.CheckedAST {
+	return a.impl
+}
+
+// AstToCheckedAST extracts the underlying *ast.CheckedAST from an Ast value.
+func AstToCheckedAST(a *Ast) *ast.CheckedAST {
+	return a.impl
+}
+
+// CheckedASTToAst wraps an *ast.CheckedAST as an Ast value.
+func CheckedASTToAst(checked *ast.CheckedAST) *Ast {
+	return &Ast{impl: checked}
+}
+
+// Optimizer rewrites a checked AST into a new, semantically equivalent checked AST.
+//
+// Implementations may fold constant sub-expressions, prune dead branches, eliminate common
+// sub-expressions, or otherwise simplify the input without changing its observable behavior.
+// An Optimizer must not mutate the *Ast it is given; it should return a new value reflecting
+// the optimization, leaving the input safe for the caller to reuse or re-check.
+type Optimizer interface {
+	// Optimize consumes a checked AST and produces a new checked AST reflecting the optimization.
+	Optimize(*Ast) (*Ast, error)
+}
+
+// newOptimizerIDGen returns a function which allocates expression IDs above the highest one
+// already present in a, so nodes introduced by an Optimizer never collide with existing ones.
+func newOptimizerIDGen(a *Ast) func() int64 {
+	nextID := ast.MaxID(ast.NavigateCheckedAST(a.impl))
+	return func() int64 {
+		id := nextID
+		nextID++
+		return id
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+)
+
+// EqualityOption configures the behavior of Equal, Hash, and CommonSubexpressions.
+type EqualityOption func(*equalityOptions)
+
+type equalityOptions struct {
+	unordered bool
+}
+
+// Unordered opts Equal, Hash, and CommonSubexpressions into unordered-map semantics: known
+// commutative call operators (+, *, ==, &&, ||) and map literal entries are compared and hashed
+// without regard to operand / entry order, so `1 + 2` equals `2 + 1` and `{a: 1, b: 2}` hashes
+// equally to `{b: 2, a: 1}`.
+func Unordered() EqualityOption {
+	return func(o *equalityOptions) { o.unordered = true }
+}
+
+var commutativeOps = map[string]bool{
+	operators.Add:        true,
+	operators.Multiply:   true,
+	operators.Equals:     true,
+	operators.LogicalAnd: true,
+	operators.LogicalOr:  true,
+}
+
+// Equal reports whether a and b represent the same expression, ignoring expression IDs and
+// source positions.
+//
+// Call argument order is significant, with one exception: when Unordered() is supplied, the
+// known-commutative operators (+, *, ==, &&, ||) and map literal entries are compared without
+// regard to order. Struct field initializers are always compared by field name rather than
+// position, since a field's identity is its name, not its order in the literal.
+func Equal(a, b NavigableExpr, opts ...EqualityOption) bool {
+	o := resolveEqualityOptions(opts)
+	return equal(a, b, o)
+}
+
+// Hash returns a hash of expr's structure and values, ignoring expression IDs and source
+// positions, such that Equal(a, b, opts...) implies Hash(a, opts...) == Hash(b, opts...). See
+// Equal for how operator and map-entry order is treated under Unordered().
+func Hash(expr NavigableExpr, opts ...EqualityOption) uint64 {
+	o := resolveEqualityOptions(opts)
+	return hashExpr(expr, o)
+}
+
+// CommonSubexpressions groups the descendants of expr (itself included) by structural hash and
+// confirms equality within each bucket, returning the equivalence classes of size >= 2.
+//
+// Each hash maps to one class. When a hash collision puts two different repeated expressions
+// in the same bucket, only the class of the one visited first is returned.
+//
+// This is the primitive a common-subexpression-elimination pass needs to find duplicated
+// sub-expressions, and which a policy engine can use to flag duplicated predicates within a
+// large disjunction.
+func CommonSubexpressions(expr NavigableExpr, opts ...EqualityOption) map[uint64][]NavigableExpr {
+	buckets := make(map[uint64][]NavigableExpr)
+	for _, node := range MatchDescendants(expr, AllMatcher()) {
+		h := Hash(node, opts...)
+		buckets[h] = append(buckets[h], node)
+	}
+	classes := make(map[uint64][]NavigableExpr)
+	for h, nodes := range buckets {
+		if len(nodes) < 2 {
+			continue
+		}
+		// A hash collision can group structurally different expressions together; confirm real
+		// equality before accepting the bucket as an equivalence class, taking the class of the
+		// first node in the bucket that has an equal partner.
+		for i, first := range nodes {
+			class := []NavigableExpr{first}
+			for _, n := range nodes[i+1:] {
+				if Equal(first, n, opts...) {
+					class = append(class, n)
+				}
+			}
+			if len(class) >= 2 {
+				classes[h] = class
+				break
+			}
+		}
+	}
+	return classes
+}
+
+func resolveEqualityOptions(opts []EqualityOption) *equalityOptions {
+	o := &equalityOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func equal(a, b NavigableExpr, o *equalityOptions) bool {
+	if a.Kind() != b.Kind() {
+		return false
+	}
+	switch a.Kind() {
+	case LiteralKind:
+		eq := a.AsLiteral().Equal(b.AsLiteral())
+		isTrue, ok := eq.(types.Bool)
+		return ok && bool(isTrue)
+	case IdentKind:
+		return a.AsIdent() == b.AsIdent()
+	case SelectKind:
+		as, bs := a.AsSelect(), b.AsSelect()
+		return as.FieldName() == bs.FieldName() &&
+			as.IsTestOnly() == bs.IsTestOnly() &&
+			equal(as.Operand(), bs.Operand(), o)
+	case CallKind:
+		return equalCall(a.AsCall(), b.AsCall(), o)
+	case ListKind:
+		ae, be := a.AsList().Elements(), b.AsList().Elements()
+		if len(ae) != len(be) {
+			return false
+		}
+		for i := range ae {
+			if !equal(ae[i], be[i], o) {
+				return false
+			}
+		}
+		return true
+	case MapKind:
+		return equalMap(a.AsMap(), b.AsMap(), o)
+	case StructKind:
+		as, bs := a.AsStruct(), b.AsStruct()
+		return as.TypeName() == bs.TypeName() && equalFields(as.Fields(), bs.Fields(), o)
+	case ComprehensionKind:
+		ac, bc := a.AsComprehension(), b.AsComprehension()
+		return ac.IterVar() == bc.IterVar() && ac.AccuVar() == bc.AccuVar() &&
+			equal(ac.IterRange(), bc.IterRange(), o) &&
+			equal(ac.AccuInit(), bc.AccuInit(), o) &&
+			equal(ac.LoopCondition(), bc.LoopCondition(), o) &&
+			equal(ac.LoopStep(), bc.LoopStep(), o) &&
+			equal(ac.Result(), bc.Result(), o)
+	default:
+		return false
+	}
+}
+
+func equalCall(a, b NavigableCallExpr, o *equalityOptions) bool {
+	if a.FunctionName() != b.FunctionName() {
+		return false
+	}
+	if (a.Target() == nil) != (b.Target() == nil) {
+		return false
+	}
+	if a.Target() != nil && !equal(a.Target(), b.Target(), o) {
+		return false
+	}
+	aArgs, bArgs := a.Args(), b.Args()
+	if len(aArgs) != len(bArgs) {
+		return false
+	}
+	if o.unordered && a.Target() == nil && commutativeOps[a.FunctionName()] {
+		return equalUnorderedSet(aArgs, bArgs, o)
+	}
+	for i := range aArgs {
+		if !equal(aArgs[i], bArgs[i], o) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalMap(a, b NavigableMapExpr, o *equalityOptions) bool {
+	aEntries, bEntries := a.Entries(), b.Entries()
+	if len(aEntries) != len(bEntries) {
+		return false
+	}
+	if !o.unordered {
+		for i := range aEntries {
+			if !equal(aEntries[i].Key(), bEntries[i].Key(), o) || !equal(aEntries[i].Value(), bEntries[i].Value(), o) {
+				return false
+			}
+		}
+		return true
+	}
+	used := make([]bool, len(bEntries))
+	for _, ae := range aEntries {
+		matched := false
+		for j, be := range bEntries {
+			if !used[j] && equal(ae.Key(), be.Key(), o) && equal(ae.Value(), be.Value(), o) {
+				used[j] = true
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// equalFields compares struct field initializers by field name rather than position, since a
+// field's identity is its name, not its order within the literal.
+func equalFields(a, b []NavigableField, o *equalityOptions) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	used := make([]bool, len(b))
+	for _, af := range a {
+		matched := false
+		for j, bf := range b {
+			if !used[j] && af.FieldName() == bf.FieldName() && equal(af.Value(), bf.Value(), o) {
+				used[j] = true
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func equalUnorderedSet(a, b []NavigableExpr, o *equalityOptions) bool {
+	used := make([]bool, len(b))
+	for _, ae := range a {
+		matched := false
+		for j, be := range b {
+			if !used[j] && equal(ae, be, o) {
+				used[j] = true
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func hashExpr(e NavigableExpr, o *equalityOptions) uint64 {
+	switch e.Kind() {
+	case LiteralKind:
+		return seedHash(LiteralKind, fmt.Sprintf("%v", e.AsLiteral().Value()))
+	case IdentKind:
+		return seedHash(IdentKind, e.AsIdent())
+	case SelectKind:
+		sel := e.AsSelect()
+		return combineOrdered(seedHash(SelectKind, sel.FieldName()), hashExpr(sel.Operand(), o))
+	case CallKind:
+		return hashCall(e.AsCall(), o)
+	case ListKind:
+		h := seedHash(ListKind, "")
+		for _, el := range e.AsList().Elements() {
+			h = combineOrdered(h, hashExpr(el, o))
+		}
+		return h
+	case MapKind:
+		return hashMap(e.AsMap(), o)
+	case StructKind:
+		s := e.AsStruct()
+		h := seedHash(StructKind, s.TypeName())
+		// Field identity is the name, not position, so struct hashing is always unordered.
+		for _, f := range s.Fields() {
+			h ^= combineOrdered(seedHash(UnspecifiedKind, f.FieldName()), hashExpr(f.Value(), o))
+		}
+		return h
+	case ComprehensionKind:
+		comp := e.AsComprehension()
+		h := seedHash(ComprehensionKind, comp.IterVar()+"|"+comp.AccuVar())
+		h = combineOrdered(h, hashExpr(comp.IterRange(), o))
+		h = combineOrdered(h, hashExpr(comp.AccuInit(), o))
+		h = combineOrdered(h, hashExpr(comp.LoopCondition(), o))
+		h = combineOrdered(h, hashExpr(comp.LoopStep(), o))
+		h = combineOrdered(h, hashExpr(comp.Result(), o))
+		return h
+	default:
+		return 0
+	}
+}
+
+func hashCall(call NavigableCallExpr, o *equalityOptions) uint64 {
+	h := seedHash(CallKind, call.FunctionName())
+	if call.Target() != nil {
+		h = combineOrdered(h, hashExpr(call.Target(), o))
+	}
+	if o.unordered && call.Target() == nil && commutativeOps[call.FunctionName()] {
+		for _, arg := range call.Args() {
+			h ^= hashExpr(arg, o)
+		}
+		return h
+	}
+	for _, arg := range call.Args() {
+		h = combineOrdered(h, hashExpr(arg, o))
+	}
+	return h
+}
+
+func hashMap(m NavigableMapExpr, o *equalityOptions) uint64 {
+	h := seedHash(MapKind, "")
+	for _, entry := range m.Entries() {
+		entryHash := combineOrdered(hashExpr(entry.Key(), o), hashExpr(entry.Value(), o))
+		if o.unordered {
+			h ^= entryHash
+		} else {
+			h = combineOrdered(h, entryHash)
+		}
+	}
+	return h
+}
+
+func seedHash(kind ExprKind, s string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte{byte(kind)})
+	hasher.Write([]byte(s))
+	return hasher.Sum64()
+}
+
+// combineOrdered folds next into seed such that the result depends on the order combineOrdered
+// was called in, so callers that need order-independence must XOR hashes together instead.
+func combineOrdered(seed, next uint64) uint64 {
+	const prime = 1099511628211
+	return (seed*prime) ^ next
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"testing"
+)
+
+func TestEqualIgnoresExpressionIDs(t *testing.T) {
+	a := parseForTest(t, "1 + 2")
+	// The right-hand side of `x == ...` is parsed after two other nodes, so its ids differ from a's.
+	b := parseForTest(t, "x == 1     +     2").AsCall().Args()[1]
+	if !Equal(a, b) {
+		t.Error("Equal() = false for structurally identical expressions with different ids")
+	}
+}
+
+func TestEqualOrderMattersWithoutUnordered(t *testing.T) {
+	a := parseForTest(t, "1 + 2")
+	b := parseForTest(t, "2 + 1")
+	if Equal(a, b) {
+		t.Error("Equal() = true for 1 + 2 vs 2 + 1 without Unordered()")
+	}
+	if !Equal(a, b, Unordered()) {
+		t.Error("Equal() = false for 1 + 2 vs 2 + 1 with Unordered()")
+	}
+}
+
+func TestEqualUnorderedMapEntries(t *testing.T) {
+	a := parseForTest(t, "{'a': 1, 'b': 2}")
+	b := parseForTest(t, "{'b': 2, 'a': 1}")
+	if Equal(a, b) {
+		t.Error("Equal() = true for differently-ordered map entries without Unordered()")
+	}
+	if !Equal(a, b, Unordered()) {
+		t.Error("Equal() = false for differently-ordered map entries with Unordered()")
+	}
+}
+
+func TestHashConsistentWithEqual(t *testing.T) {
+	a := parseForTest(t, "1 + 2")
+	b := parseForTest(t, "2 + 1")
+	if Hash(a, Unordered()) != Hash(b, Unordered()) {
+		t.Error("Hash() differs for expressions that Equal() considers equal under Unordered()")
+	}
+}
+
+func TestCommonSubexpressions(t *testing.T) {
+	expr := parseForTest(t, "(x + y) * (x + y)")
+	classes := CommonSubexpressions(expr)
+	found := false
+	for _, class := range classes {
+		if len(class) == 2 && class[0].Kind() == CallKind {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("CommonSubexpressions() = %v, wanted an equivalence class for the repeated `x + y` subexpression", classes)
+	}
+}
+
+func TestCommonSubexpressionsNoDuplicates(t *testing.T) {
+	expr := parseForTest(t, "x + y")
+	classes := CommonSubexpressions(expr)
+	if len(classes) != 0 {
+		t.Errorf("CommonSubexpressions() = %v, wanted no equivalence classes (nothing repeats)", classes)
+	}
+}
@@ -142,6 +142,115 @@ func matchIsConstantValue(e NavigableExpr) bool {
 	return false
 }
 
+// Visitor defines an object for visiting NavigableExpr and NavigableEntry nodes within an expression graph.
+type Visitor interface {
+	// VisitExpr visits the given expression.
+	VisitExpr(NavigableExpr)
+
+	// VisitEntryExpr visits the given map entry.
+	VisitEntryExpr(NavigableEntry)
+}
+
+type baseVisitor struct {
+	visitExpr  func(NavigableExpr)
+	visitEntry func(NavigableEntry)
+}
+
+// VisitExpr visits the given expression if a visitExpr function was configured.
+func (v *baseVisitor) VisitExpr(e NavigableExpr) {
+	if v.visitExpr != nil {
+		v.visitExpr(e)
+	}
+}
+
+// VisitEntryExpr visits the given map entry if a visitEntry function was configured.
+func (v *baseVisitor) VisitEntryExpr(e NavigableEntry) {
+	if v.visitEntry != nil {
+		v.visitEntry(e)
+	}
+}
+
+// NewExprVisitor creates a visitor which only visits expression nodes, ignoring map entries.
+func NewExprVisitor(fn func(NavigableExpr)) Visitor {
+	return &baseVisitor{visitExpr: fn}
+}
+
+// PreOrderVisit walks the expression graph rooted at expr and calls the visitor on each node
+// before visiting its children.
+//
+// Child ordering is stable: a call's target is visited before its args, a map's keys before
+// their values, and a comprehension's iter-range, accu-init, loop-condition, loop-step, and
+// result are visited in that order. The traversal is iterative, using an explicit stack rather
+// than recursion, so deeply nested ASTs will not overflow the call stack.
+func PreOrderVisit(expr NavigableExpr, visitor Visitor) {
+	stack := []NavigableExpr{expr}
+	for len(stack) != 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		visitor.VisitExpr(e)
+		visitMapEntries(e, visitor)
+		children := e.Children()
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, children[i])
+		}
+	}
+}
+
+// PostOrderVisit walks the expression graph rooted at expr and calls the visitor on each node
+// after visiting its children.
+//
+// Child ordering follows the same rules as PreOrderVisit. The traversal is iterative, using an
+// explicit stack rather than recursion, so deeply nested ASTs will not overflow the call stack.
+func PostOrderVisit(expr NavigableExpr, visitor Visitor) {
+	stack := []NavigableExpr{expr}
+	var order []NavigableExpr
+	for len(stack) != 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		order = append(order, e)
+		for _, child := range e.Children() {
+			stack = append(stack, child)
+		}
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		e := order[i]
+		visitor.VisitExpr(e)
+		visitMapEntries(e, visitor)
+	}
+}
+
+func visitMapEntries(e NavigableExpr, visitor Visitor) {
+	if e.Kind() != MapKind {
+		return
+	}
+	for _, entry := range e.AsMap().Entries() {
+		visitor.VisitEntryExpr(entry)
+	}
+}
+
+// MaxID returns one greater than the largest expression ID found within the given NavigableExpr.
+//
+// Expr_CreateStruct_Entry.Id values -- allocated for map entries and struct field initializers --
+// share the same ID space as Expr.Id, so they are considered here as well; otherwise a fresh ID
+// generator seeded from MaxID could collide with an entry ID already present in the AST.
+//
+// This is useful for optimizers and other AST-rewriting passes which need to allocate fresh,
+// globally-unique expression IDs when introducing new nodes into an existing AST.
+func MaxID(expr NavigableExpr) int64 {
+	maxID := expr.ID()
+	PostOrderVisit(expr, NewExprVisitor(func(e NavigableExpr) {
+		if e.ID() > maxID {
+			maxID = e.ID()
+		}
+		for _, entry := range e.ToExpr().GetStructExpr().GetEntries() {
+			if entry.GetId() > maxID {
+				maxID = entry.GetId()
+			}
+		}
+	}))
+	return maxID + 1
+}
+
 // NavigableExpr represents the base navigable expression value.
 //
 // Depending on the `Kind()` value, the NavigableExpr may be converted to a concrete expression types
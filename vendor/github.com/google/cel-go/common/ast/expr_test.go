@@ -0,0 +1,83 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/cel-go/common/types"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+func testIntLit(id int64, v int64) *exprpb.Expr {
+	return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_Int64Value{Int64Value: v}}}}
+}
+
+func testCall(id int64, fn string, args ...*exprpb.Expr) *exprpb.Expr {
+	return &exprpb.Expr{Id: id, ExprKind: &exprpb.Expr_CallExpr{CallExpr: &exprpb.Expr_Call{Function: fn, Args: args}}}
+}
+
+func TestPostOrderVisit(t *testing.T) {
+	// (1 + 2) + 3
+	expr := testCall(4, "_+_", testCall(3, "_+_", testIntLit(1, 1), testIntLit(2, 2)), testIntLit(5, 3))
+	root := NavigateCheckedAST(&CheckedAST{Expr: expr, TypeMap: map[int64]*types.Type{}})
+	var visited []int64
+	PostOrderVisit(root, NewExprVisitor(func(e NavigableExpr) {
+		visited = append(visited, e.ID())
+	}))
+	want := []int64{1, 2, 3, 5, 4}
+	if !reflect.DeepEqual(visited, want) {
+		t.Errorf("PostOrderVisit() visited ids %v, wanted %v", visited, want)
+	}
+}
+
+func TestPreOrderVisit(t *testing.T) {
+	// (1 + 2) + 3
+	expr := testCall(4, "_+_", testCall(3, "_+_", testIntLit(1, 1), testIntLit(2, 2)), testIntLit(5, 3))
+	root := NavigateCheckedAST(&CheckedAST{Expr: expr, TypeMap: map[int64]*types.Type{}})
+	var visited []int64
+	PreOrderVisit(root, NewExprVisitor(func(e NavigableExpr) {
+		visited = append(visited, e.ID())
+	}))
+	want := []int64{4, 3, 1, 2, 5}
+	if !reflect.DeepEqual(visited, want) {
+		t.Errorf("PreOrderVisit() visited ids %v, wanted %v", visited, want)
+	}
+}
+
+func TestMaxID(t *testing.T) {
+	expr := testCall(4, "_+_", testIntLit(1, 1), testIntLit(2, 2))
+	root := NavigateCheckedAST(&CheckedAST{Expr: expr, TypeMap: map[int64]*types.Type{}})
+	if got := MaxID(root); got != 5 {
+		t.Errorf("MaxID() = %d, wanted 5", got)
+	}
+}
+
+func TestMaxIDIncludesCreateStructEntries(t *testing.T) {
+	// {1: 2} with the map entry wrapper allocated the highest id in the tree.
+	mapExpr := &exprpb.Expr{Id: 1, ExprKind: &exprpb.Expr_StructExpr{StructExpr: &exprpb.Expr_CreateStruct{
+		Entries: []*exprpb.Expr_CreateStruct_Entry{{
+			Id:      9,
+			KeyKind: &exprpb.Expr_CreateStruct_Entry_MapKey{MapKey: testIntLit(2, 1)},
+			Value:   testIntLit(3, 2),
+		}},
+	}}}
+	root := NavigateCheckedAST(&CheckedAST{Expr: mapExpr, TypeMap: map[int64]*types.Type{}})
+	if got := MaxID(root); got != 10 {
+		t.Errorf("MaxID() = %d, wanted 10 (one greater than the entry id 9)", got)
+	}
+}
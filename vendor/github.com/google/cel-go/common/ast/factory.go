@@ -0,0 +1,272 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/protobuf/proto"
+)
+
+// MutableExpr represents a newly constructed or rewritten expression node, prior to being
+// spliced back into a CheckedAST by ApplyRewrite.
+//
+// Unlike NavigableExpr, a MutableExpr carries no parent or type information of its own; it is
+// the raw proto representation that the rest of the AST machinery already operates on.
+type MutableExpr = *exprpb.Expr
+
+// MutableEntry represents a single key-value pair to be passed to ExprFactory.NewMap.
+type MutableEntry struct {
+	Key        MutableExpr
+	Value      MutableExpr
+	IsOptional bool
+}
+
+// MutableField represents a single field initializer to be passed to ExprFactory.NewStruct.
+type MutableField struct {
+	Name       string
+	Value      MutableExpr
+	IsOptional bool
+}
+
+// IDGenerator allocates monotonically increasing expression IDs for newly constructed nodes.
+type IDGenerator interface {
+	// NextID returns the next available expression ID.
+	NextID() int64
+}
+
+// NewIDGenerator returns an IDGenerator which begins allocating at seed, such as the value
+// returned by MaxID, so that generated IDs never collide with an existing AST.
+func NewIDGenerator(seed int64) IDGenerator {
+	return &idGenerator{next: seed}
+}
+
+type idGenerator struct {
+	next int64
+}
+
+func (gen *idGenerator) NextID() int64 {
+	id := gen.next
+	gen.next++
+	return id
+}
+
+// ExprFactory builds new expression nodes with fresh, collision-free IDs.
+//
+// Use NewExprFactory to construct one seeded from an existing AST's MaxID so that nodes it
+// produces can be safely spliced into that AST.
+type ExprFactory interface {
+	// NewCall creates a global function call expression, e.g. `size(x)`.
+	NewCall(function string, args ...MutableExpr) MutableExpr
+
+	// NewMemberCall creates a receiver-style function call expression, e.g. `x.size()`.
+	NewMemberCall(function string, target MutableExpr, args ...MutableExpr) MutableExpr
+
+	// NewLiteral creates a constant literal expression from the given value.
+	NewLiteral(value ref.Val) MutableExpr
+
+	// NewList creates a list literal expression from the given elements.
+	NewList(elems ...MutableExpr) MutableExpr
+
+	// NewMap creates a map literal expression from the given entries.
+	NewMap(entries ...MutableEntry) MutableExpr
+
+	// NewStruct creates a message literal expression of the given type from its field initializers.
+	NewStruct(typeName string, fields ...MutableField) MutableExpr
+
+	// NewComprehension creates a comprehension expression from its constituent sub-expressions.
+	NewComprehension(iterRange MutableExpr, iterVar, accuVar string, accuInit, loopCondition, loopStep, result MutableExpr) MutableExpr
+
+	// NewSelect creates a field selection expression, e.g. `x.y`.
+	NewSelect(operand MutableExpr, field string) MutableExpr
+
+	// NewIdent creates an identifier expression, e.g. `x`.
+	NewIdent(name string) MutableExpr
+}
+
+// NewExprFactory creates an ExprFactory which allocates IDs from the given IDGenerator.
+func NewExprFactory(gen IDGenerator) ExprFactory {
+	return &exprFactory{gen: gen}
+}
+
+type exprFactory struct {
+	gen IDGenerator
+}
+
+func (fac *exprFactory) nextID() int64 {
+	return fac.gen.NextID()
+}
+
+func (fac *exprFactory) NewCall(function string, args ...MutableExpr) MutableExpr {
+	return &exprpb.Expr{
+		Id: fac.nextID(),
+		ExprKind: &exprpb.Expr_CallExpr{
+			CallExpr: &exprpb.Expr_Call{Function: function, Args: args},
+		},
+	}
+}
+
+func (fac *exprFactory) NewMemberCall(function string, target MutableExpr, args ...MutableExpr) MutableExpr {
+	return &exprpb.Expr{
+		Id: fac.nextID(),
+		ExprKind: &exprpb.Expr_CallExpr{
+			CallExpr: &exprpb.Expr_Call{Function: function, Target: target, Args: args},
+		},
+	}
+}
+
+func (fac *exprFactory) NewLiteral(value ref.Val) MutableExpr {
+	c, err := ValToConstant(value)
+	if err != nil {
+		panic(err)
+	}
+	return &exprpb.Expr{
+		Id:       fac.nextID(),
+		ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: c},
+	}
+}
+
+func (fac *exprFactory) NewList(elems ...MutableExpr) MutableExpr {
+	return &exprpb.Expr{
+		Id: fac.nextID(),
+		ExprKind: &exprpb.Expr_ListExpr{
+			ListExpr: &exprpb.Expr_CreateList{Elements: elems},
+		},
+	}
+}
+
+func (fac *exprFactory) NewMap(entries ...MutableEntry) MutableExpr {
+	pbEntries := make([]*exprpb.Expr_CreateStruct_Entry, len(entries))
+	for i, e := range entries {
+		pbEntries[i] = &exprpb.Expr_CreateStruct_Entry{
+			Id:            fac.nextID(),
+			KeyKind:       &exprpb.Expr_CreateStruct_Entry_MapKey{MapKey: e.Key},
+			Value:         e.Value,
+			OptionalEntry: e.IsOptional,
+		}
+	}
+	return &exprpb.Expr{
+		Id: fac.nextID(),
+		ExprKind: &exprpb.Expr_StructExpr{
+			StructExpr: &exprpb.Expr_CreateStruct{Entries: pbEntries},
+		},
+	}
+}
+
+func (fac *exprFactory) NewStruct(typeName string, fields ...MutableField) MutableExpr {
+	pbEntries := make([]*exprpb.Expr_CreateStruct_Entry, len(fields))
+	for i, f := range fields {
+		pbEntries[i] = &exprpb.Expr_CreateStruct_Entry{
+			Id:            fac.nextID(),
+			KeyKind:       &exprpb.Expr_CreateStruct_Entry_FieldKey{FieldKey: f.Name},
+			Value:         f.Value,
+			OptionalEntry: f.IsOptional,
+		}
+	}
+	return &exprpb.Expr{
+		Id: fac.nextID(),
+		ExprKind: &exprpb.Expr_StructExpr{
+			StructExpr: &exprpb.Expr_CreateStruct{MessageName: typeName, Entries: pbEntries},
+		},
+	}
+}
+
+func (fac *exprFactory) NewComprehension(iterRange MutableExpr, iterVar, accuVar string, accuInit, loopCondition, loopStep, result MutableExpr) MutableExpr {
+	return &exprpb.Expr{
+		Id: fac.nextID(),
+		ExprKind: &exprpb.Expr_ComprehensionExpr{
+			ComprehensionExpr: &exprpb.Expr_Comprehension{
+				IterRange:     iterRange,
+				IterVar:       iterVar,
+				AccuVar:       accuVar,
+				AccuInit:      accuInit,
+				LoopCondition: loopCondition,
+				LoopStep:      loopStep,
+				Result:        result,
+			},
+		},
+	}
+}
+
+func (fac *exprFactory) NewSelect(operand MutableExpr, field string) MutableExpr {
+	return &exprpb.Expr{
+		Id: fac.nextID(),
+		ExprKind: &exprpb.Expr_SelectExpr{
+			SelectExpr: &exprpb.Expr_Select{Operand: operand, Field: field},
+		},
+	}
+}
+
+func (fac *exprFactory) NewIdent(name string) MutableExpr {
+	return &exprpb.Expr{
+		Id:       fac.nextID(),
+		ExprKind: &exprpb.Expr_IdentExpr{IdentExpr: &exprpb.Expr_Ident{Name: name}},
+	}
+}
+
+// Rewriter rewrites a NavigableExpr into a MutableExpr, returning false if no rewrite applies to
+// the given node.
+//
+// RewriteExpr is invoked in post-order by ApplyRewrite, so a node's children have already been
+// rewritten and spliced back into the tree before the node itself is visited.
+//
+// A Rewriter that changes a node's type must report it via RewriteType; ApplyRewrite otherwise
+// has no way to tell the replacement apart from the original and falls back to the original
+// node's checker-inferred type.
+type Rewriter interface {
+	RewriteExpr(NavigableExpr) (MutableExpr, bool)
+
+	// RewriteType returns the type to record for the MutableExpr most recently returned from
+	// RewriteExpr, or nil to keep the original node's type.
+	RewriteType() *types.Type
+}
+
+// ApplyRewrite walks checked in post-order, invoking rewriter at each node, and returns a new
+// *CheckedAST with the accepted rewrites spliced in and the TypeMap updated to match, leaving
+// checked itself untouched -- the whole point of a mutation API sitting on top of the read-only
+// NavigableExpr is that it returns a new AST rather than rewriting the caller's in place.
+//
+// Rewritten nodes which do not carry an explicit ID (MutableExpr.GetId() == 0) are assigned one
+// above MaxID(checked), so rewrites never collide with an ID already present in the AST.
+func ApplyRewrite(checked *CheckedAST, rewriter Rewriter) *CheckedAST {
+	gen := NewIDGenerator(MaxID(NavigateCheckedAST(checked)))
+	typeMap := make(map[int64]*types.Type, len(checked.TypeMap))
+	for id, t := range checked.TypeMap {
+		typeMap[id] = t
+	}
+	out := &CheckedAST{Expr: proto.Clone(checked.Expr).(*exprpb.Expr), TypeMap: typeMap}
+	PostOrderVisit(NavigateCheckedAST(out), NewExprVisitor(func(e NavigableExpr) {
+		replacement, ok := rewriter.RewriteExpr(e)
+		if !ok {
+			return
+		}
+		if replacement.GetId() == 0 {
+			replacement.Id = gen.NextID()
+		}
+		oldID := e.ID()
+		nodeType := rewriter.RewriteType()
+		if nodeType == nil {
+			nodeType = e.Type()
+		}
+		*e.ToExpr() = *replacement
+		if oldID != replacement.GetId() {
+			delete(out.TypeMap, oldID)
+		}
+		out.TypeMap[replacement.GetId()] = nodeType
+	}))
+	return out
+}
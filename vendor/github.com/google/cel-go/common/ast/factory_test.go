@@ -0,0 +1,107 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/common/types"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+func TestApplyRewriteDeletesOldTypeMapEntry(t *testing.T) {
+	// x + 1, where x is rewritten to the literal 2.
+	expr := testCall(3, "_+_", &exprpb.Expr{Id: 1, ExprKind: &exprpb.Expr_IdentExpr{IdentExpr: &exprpb.Expr_Ident{Name: "x"}}}, testIntLit(2, 1))
+	checked := &CheckedAST{Expr: expr, TypeMap: map[int64]*types.Type{1: types.IntType, 2: types.IntType, 3: types.IntType}}
+
+	gen := NewIDGenerator(MaxID(NavigateCheckedAST(checked)))
+	rewriter := &fixedIDRewriter{
+		target:      1,
+		replacement: &exprpb.Expr{Id: gen.NextID(), ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_Int64Value{Int64Value: 2}}}},
+		newType:     types.IntType,
+	}
+	out := ApplyRewrite(checked, rewriter)
+
+	if _, found := out.TypeMap[1]; found {
+		t.Errorf("TypeMap still has an entry for the replaced node's old id 1")
+	}
+	if out.TypeMap[rewriter.replacement.GetId()] != types.IntType {
+		t.Errorf("TypeMap[%d] = %v, wanted IntType", rewriter.replacement.GetId(), out.TypeMap[rewriter.replacement.GetId()])
+	}
+}
+
+func TestApplyRewriteUsesRewriterType(t *testing.T) {
+	// x, originally typed as a string, rewritten to the int literal 2.
+	expr := &exprpb.Expr{Id: 1, ExprKind: &exprpb.Expr_IdentExpr{IdentExpr: &exprpb.Expr_Ident{Name: "x"}}}
+	checked := &CheckedAST{Expr: expr, TypeMap: map[int64]*types.Type{1: types.StringType}}
+
+	rewriter := &fixedIDRewriter{
+		target:      1,
+		replacement: &exprpb.Expr{Id: 1, ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_Int64Value{Int64Value: 2}}}},
+		newType:     types.IntType,
+	}
+	out := ApplyRewrite(checked, rewriter)
+
+	if out.TypeMap[1] != types.IntType {
+		t.Errorf("TypeMap[1] = %v, wanted the rewriter-supplied IntType, not the stale original type", out.TypeMap[1])
+	}
+}
+
+func TestApplyRewriteDoesNotMutateInput(t *testing.T) {
+	// x + 1, where x is rewritten to the literal 2.
+	expr := testCall(3, "_+_", &exprpb.Expr{Id: 1, ExprKind: &exprpb.Expr_IdentExpr{IdentExpr: &exprpb.Expr_Ident{Name: "x"}}}, testIntLit(2, 1))
+	checked := &CheckedAST{Expr: expr, TypeMap: map[int64]*types.Type{1: types.IntType, 2: types.IntType, 3: types.IntType}}
+
+	gen := NewIDGenerator(MaxID(NavigateCheckedAST(checked)))
+	rewriter := &fixedIDRewriter{
+		target:      1,
+		replacement: &exprpb.Expr{Id: gen.NextID(), ExprKind: &exprpb.Expr_ConstExpr{ConstExpr: &exprpb.Constant{ConstantKind: &exprpb.Constant_Int64Value{Int64Value: 2}}}},
+		newType:     types.IntType,
+	}
+	ApplyRewrite(checked, rewriter)
+
+	root := NavigateCheckedAST(checked)
+	if root.Kind() != CallKind {
+		t.Fatalf("ApplyRewrite() mutated its input; got %v, wanted the original x + 1 call untouched", root.ToExpr())
+	}
+	if ident := root.Children()[0]; ident.Kind() != IdentKind || ident.AsIdent() != "x" {
+		t.Errorf("ApplyRewrite() mutated its input; got %v, wanted the original identifier \"x\" untouched", ident.ToExpr())
+	}
+	if len(checked.TypeMap) != 3 {
+		t.Errorf("ApplyRewrite() mutated the input's TypeMap; got %d entries, wanted 3", len(checked.TypeMap))
+	}
+}
+
+// fixedIDRewriter rewrites exactly one node, identified by its original id, to a fixed
+// replacement and reports a fixed replacement type.
+type fixedIDRewriter struct {
+	target      int64
+	replacement MutableExpr
+	newType     *types.Type
+	rewrote     bool
+}
+
+func (r *fixedIDRewriter) RewriteExpr(e NavigableExpr) (MutableExpr, bool) {
+	if r.rewrote || e.ID() != r.target {
+		return nil, false
+	}
+	r.rewrote = true
+	return r.replacement, true
+}
+
+func (r *fixedIDRewriter) RewriteType() *types.Type {
+	return r.newType
+}
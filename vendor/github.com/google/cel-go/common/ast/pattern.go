@@ -0,0 +1,247 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/parser"
+
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// matchesWantType reports whether candidate satisfies a typed metavariable's `:wantType`
+// constraint. A compiled pattern is parsed but never checked, and candidates are frequently
+// matched before checking too, so candidate.Type() is often just the DynType fallback rather than
+// a real checker-inferred type; in that case fall back to the type implied by the node's own
+// literal value, which is exactly the kind of `$x:int`-style constraint a typed metavariable is
+// meant to express.
+func matchesWantType(candidate NavigableExpr, wantType string) bool {
+	if t := candidate.Type(); t != types.DynType {
+		return t.String() == wantType
+	}
+	if candidate.Kind() != LiteralKind {
+		return false
+	}
+	return candidate.AsLiteral().Type().TypeName() == wantType
+}
+
+// metavarRegex recognizes the metavariable syntax `$name` or the typed form `$name:type`
+// anywhere it appears in a pattern string, so it can be rewritten into an identifier the CEL
+// parser will accept before compilation.
+var metavarRegex = regexp.MustCompile(`\$([a-zA-Z_][a-zA-Z0-9_]*)(:[a-zA-Z_][a-zA-Z0-9_.]*)?`)
+
+// metavarPrefix namespaces the sanitized identifiers substituted for metavariables so they can
+// never collide with an identifier the pattern author actually wrote.
+const metavarPrefix = "__patternMetavar_"
+
+type metavarInfo struct {
+	name     string
+	wantType string
+}
+
+type compiledPattern struct {
+	root     NavigableExpr
+	metavars map[string]metavarInfo
+}
+
+// PatternMatcher compiles pattern -- a CEL expression that may contain metavariables such as
+// `$x`, `$fn(_, $arg)`, or typed metavariables like `$x:int` -- into an ExprMatcher that performs
+// structural unification against candidate expressions.
+//
+// `_` matches any sub-expression without binding it; `$x` binds any sub-expression to the name
+// `x`, and a repeated `$x` must unify to the same sub-tree on every occurrence. A typed
+// metavariable like `$x:int` additionally requires the bound sub-expression's type to match.
+//
+// Use MatchBindings instead of PatternMatcher directly when the captured bindings, rather than
+// just a yes/no match, are needed.
+func PatternMatcher(pattern string) (ExprMatcher, error) {
+	p, err := compilePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return p.match, nil
+}
+
+// MatchBindings compiles pattern and evaluates it against expr and each of its descendants,
+// returning the metavariable bindings captured by every successful match. This is the
+// counterpart to PatternMatcher for callers that need the captures rather than a boolean result,
+// e.g. to build lint rules like "flag `size($x) == 0` and suggest `$x.size() == 0`".
+func MatchBindings(expr NavigableExpr, pattern string) ([]map[string]NavigableExpr, error) {
+	p, err := compilePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var results []map[string]NavigableExpr
+	for _, candidate := range MatchDescendants(expr, p.match) {
+		if bindings, ok := p.matches(candidate); ok {
+			results = append(results, bindings)
+		}
+	}
+	return results, nil
+}
+
+func compilePattern(pattern string) (*compiledPattern, error) {
+	sanitized, metavars := sanitizeMetavars(pattern)
+	parsed, iss := parser.Parse(common.NewTextSource(sanitized))
+	if iss != nil && len(iss.GetErrors()) != 0 {
+		return nil, fmt.Errorf("invalid pattern %q: %s", pattern, iss.ToDisplayString())
+	}
+	root := NavigateCheckedAST(&CheckedAST{Expr: parsed.GetExpr(), TypeMap: map[int64]*types.Type{}})
+	return &compiledPattern{root: root, metavars: metavars}, nil
+}
+
+func sanitizeMetavars(pattern string) (string, map[string]metavarInfo) {
+	metavars := make(map[string]metavarInfo)
+	sanitized := metavarRegex.ReplaceAllStringFunc(pattern, func(tok string) string {
+		m := metavarRegex.FindStringSubmatch(tok)
+		name := m[1]
+		wantType := strings.TrimPrefix(m[2], ":")
+		safeName := metavarPrefix + name
+		metavars[safeName] = metavarInfo{name: name, wantType: wantType}
+		return safeName
+	})
+	return sanitized, metavars
+}
+
+func (p *compiledPattern) match(e NavigableExpr) bool {
+	_, ok := p.matches(e)
+	return ok
+}
+
+// matches attempts to unify the compiled pattern against e, returning the metavariable bindings
+// captured along the way if, and only if, the whole pattern unifies.
+func (p *compiledPattern) matches(e NavigableExpr) (map[string]NavigableExpr, bool) {
+	bindings := make(map[string]NavigableExpr)
+	if unify(p.root, e, p.metavars, bindings) {
+		return bindings, true
+	}
+	return nil, false
+}
+
+// unify performs a structural match of pattern against candidate, recording metavariable
+// bindings as they are encountered. `_` matches anything without binding; a metavariable binds
+// on first sight and must unify to a structurally equal sub-tree on every later occurrence.
+func unify(pattern, candidate NavigableExpr, metavars map[string]metavarInfo, bindings map[string]NavigableExpr) bool {
+	if pattern.Kind() == IdentKind {
+		name := pattern.AsIdent()
+		if name == "_" {
+			return true
+		}
+		if info, isMetavar := metavars[name]; isMetavar {
+			if info.wantType != "" && !matchesWantType(candidate, info.wantType) {
+				return false
+			}
+			if bound, seen := bindings[info.name]; seen {
+				return structurallyEqual(bound, candidate)
+			}
+			bindings[info.name] = candidate
+			return true
+		}
+	}
+	if pattern.Kind() != candidate.Kind() {
+		return false
+	}
+	switch pattern.Kind() {
+	case LiteralKind:
+		return structurallyEqual(pattern, candidate)
+	case IdentKind:
+		return pattern.AsIdent() == candidate.AsIdent()
+	case SelectKind:
+		ps, cs := pattern.AsSelect(), candidate.AsSelect()
+		return ps.FieldName() == cs.FieldName() && unify(ps.Operand(), cs.Operand(), metavars, bindings)
+	case CallKind:
+		pc, cc := pattern.AsCall(), candidate.AsCall()
+		if !unifyFunctionName(pc.FunctionName(), cc.FunctionName(), metavars, bindings) {
+			return false
+		}
+		if (pc.Target() == nil) != (cc.Target() == nil) {
+			return false
+		}
+		if pc.Target() != nil && !unify(pc.Target(), cc.Target(), metavars, bindings) {
+			return false
+		}
+		pArgs, cArgs := pc.Args(), cc.Args()
+		if len(pArgs) != len(cArgs) {
+			return false
+		}
+		for i := range pArgs {
+			if !unify(pArgs[i], cArgs[i], metavars, bindings) {
+				return false
+			}
+		}
+		return true
+	case ListKind:
+		pElems, cElems := pattern.AsList().Elements(), candidate.AsList().Elements()
+		if len(pElems) != len(cElems) {
+			return false
+		}
+		for i := range pElems {
+			if !unify(pElems[i], cElems[i], metavars, bindings) {
+				return false
+			}
+		}
+		return true
+	default:
+		// Map, struct, and comprehension patterns don't yet support metavariables; fall back to
+		// plain structural equality.
+		return structurallyEqual(pattern, candidate)
+	}
+}
+
+// unifyFunctionName matches a call's function-name slot, which sanitizeMetavars rewrites to a
+// plain identifier like `__patternMetavar_fn` rather than leaving it as an IdentKind node -- so
+// the IdentKind case in unify never sees it and this needs its own metavariable handling. The
+// candidate's name is wrapped in a synthetic IdentKind NavigableExpr so it can be bound and
+// compared the same way any other metavariable binding is.
+func unifyFunctionName(patternFn, candidateFn string, metavars map[string]metavarInfo, bindings map[string]NavigableExpr) bool {
+	info, isMetavar := metavars[patternFn]
+	if !isMetavar {
+		return patternFn == candidateFn
+	}
+	candidateIdent := newNavigableExpr(nil, &exprpb.Expr{
+		ExprKind: &exprpb.Expr_IdentExpr{IdentExpr: &exprpb.Expr_Ident{Name: candidateFn}},
+	}, map[int64]*types.Type{})
+	if bound, seen := bindings[info.name]; seen {
+		return structurallyEqual(bound, candidateIdent)
+	}
+	bindings[info.name] = candidateIdent
+	return true
+}
+
+// structurallyEqual reports whether a and b have the same shape and values, ignoring expression
+// IDs. It is intentionally local to pattern matching; Equal provides the general-purpose,
+// publicly supported equivalent.
+func structurallyEqual(a, b NavigableExpr) bool {
+	if a.Kind() != b.Kind() {
+		return false
+	}
+	switch a.Kind() {
+	case LiteralKind:
+		eq := a.AsLiteral().Equal(b.AsLiteral())
+		isTrue, ok := eq.(types.Bool)
+		return ok && bool(isTrue)
+	case IdentKind:
+		return a.AsIdent() == b.AsIdent()
+	default:
+		// Children alone omit a node's own parts (a call's function name, a select's field, a
+		// message's type name, a comprehension's variables), so compare the whole node.
+		return Equal(a, b)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"testing"
+
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/parser"
+)
+
+func parseForTest(t *testing.T, expr string) NavigableExpr {
+	t.Helper()
+	parsed, iss := parser.Parse(common.NewTextSource(expr))
+	if iss != nil && len(iss.GetErrors()) != 0 {
+		t.Fatalf("parser.Parse(%q) failed: %s", expr, iss.ToDisplayString())
+	}
+	return NavigateCheckedAST(&CheckedAST{Expr: parsed.GetExpr(), TypeMap: map[int64]*types.Type{}})
+}
+
+func TestPatternMatcherWildcard(t *testing.T) {
+	matcher, err := PatternMatcher("size(_)")
+	if err != nil {
+		t.Fatalf("PatternMatcher() failed: %v", err)
+	}
+	if !matcher(parseForTest(t, "size(x)")) {
+		t.Error("matcher(size(x)) = false, wanted true")
+	}
+	if matcher(parseForTest(t, "x.size()")) {
+		t.Error("matcher(x.size()) = true, wanted false (target-less call doesn't match a member call)")
+	}
+}
+
+func TestPatternMatcherRepeatedMetavarMustUnify(t *testing.T) {
+	matcher, err := PatternMatcher("$x + $x")
+	if err != nil {
+		t.Fatalf("PatternMatcher() failed: %v", err)
+	}
+	if !matcher(parseForTest(t, "1 + 1")) {
+		t.Error("matcher(1 + 1) = false, wanted true")
+	}
+	if matcher(parseForTest(t, "1 + 2")) {
+		t.Error("matcher(1 + 2) = true, wanted false ($x must bind to the same value both times)")
+	}
+}
+
+func TestPatternMatcherTypedMetavar(t *testing.T) {
+	matcher, err := PatternMatcher("$x:int")
+	if err != nil {
+		t.Fatalf("PatternMatcher() failed: %v", err)
+	}
+	if !matcher(parseForTest(t, "1")) {
+		t.Error("matcher(1) = false, wanted true")
+	}
+	if matcher(parseForTest(t, "'a'")) {
+		t.Error("matcher('a') = true, wanted false (string isn't int)")
+	}
+}
+
+func TestPatternMatcherFunctionNameMetavar(t *testing.T) {
+	// $fn(_, $arg) must bind the function name itself, not just its arguments.
+	bindings, err := MatchBindings(parseForTest(t, "max(1, 2)"), "$fn(_, $arg)")
+	if err != nil {
+		t.Fatalf("MatchBindings() failed: %v", err)
+	}
+	if len(bindings) != 1 {
+		t.Fatalf("MatchBindings() returned %d matches, wanted 1", len(bindings))
+	}
+	fn, ok := bindings[0]["fn"]
+	if !ok {
+		t.Fatal("MatchBindings() did not bind $fn")
+	}
+	if fn.Kind() != IdentKind || fn.AsIdent() != "max" {
+		t.Errorf("$fn bound to %v, wanted the identifier \"max\"", fn.ToExpr())
+	}
+	arg, ok := bindings[0]["arg"]
+	if !ok || arg.Kind() != LiteralKind {
+		t.Error("$arg was not bound to the literal 2")
+	}
+}
+
+func TestPatternMatcherFunctionNameMetavarRejectsMismatch(t *testing.T) {
+	// A repeated $fn must still refer to the same function name.
+	matcher, err := PatternMatcher("$fn(1) || $fn(2)")
+	if err != nil {
+		t.Fatalf("PatternMatcher() failed: %v", err)
+	}
+	if !matcher(parseForTest(t, "max(1) || max(2)")) {
+		t.Error("matcher(max(1) || max(2)) = false, wanted true")
+	}
+	if matcher(parseForTest(t, "max(1) || min(2)")) {
+		t.Error("matcher(max(1) || min(2)) = true, wanted false (repeated $fn must match the same name)")
+	}
+}